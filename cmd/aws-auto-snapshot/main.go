@@ -0,0 +1,72 @@
+// Command aws-auto-snapshot creates or prunes scheduled snapshots for the
+// configured backend.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/gce"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot/ec2"
+)
+
+func main() {
+	backend := flag.String("backend", envOrDefault("AUTO_SNAPSHOT_BACKEND", "aws"), "backend to use: aws or gce")
+	gceProject := flag.String("gce-project", os.Getenv("GCE_PROJECT"), "GCP project ID (required for the gce backend)")
+	prune := flag.Bool("prune", false, "prune expired snapshots instead of creating new ones")
+	flag.Parse()
+
+	ctx := context.Background()
+	store := datastore.NewMemory()
+
+	snapshotter, err := newSnapshotter(ctx, *backend, *gceProject, store)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *prune {
+		err = snapshotter.Prune(ctx)
+	} else {
+		err = snapshotter.Snapshot(ctx)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newSnapshotter(ctx context.Context, backend, gceProject string, store datastore.Datastore) (datastore.Snapshotter, error) {
+	switch backend {
+	case "aws":
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return ec2.NewSnapshotManager(awsec2.New(sess), store), nil
+	case "gce":
+		if gceProject == "" {
+			return nil, fmt.Errorf("gce backend requires -gce-project or GCE_PROJECT to be set")
+		}
+		client, err := compute.NewService(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return gce.NewSnapshotManager(client, gceProject, store), nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q, must be one of: aws, gce", backend)
+	}
+}
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
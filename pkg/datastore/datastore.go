@@ -0,0 +1,40 @@
+// Package datastore defines the persistence interface used to keep track of
+// snapshots created by the various backup managers (e.g. pkg/snapshot/ec2) across
+// restarts.
+package datastore
+
+import "time"
+
+// SnapshotID identifies a single snapshot within a Datastore
+type SnapshotID string
+
+// SnapshotResource identifies the resource (e.g. an EBS volume) a snapshot
+// was taken from
+type SnapshotResource string
+
+// SnapshotInfo describes a single snapshot tracked in the Datastore
+type SnapshotInfo struct {
+	Resource  SnapshotResource
+	ID        SnapshotID
+	CreatedAt time.Time
+}
+
+// SnapshotCopyInfo describes a cross-region copy of a snapshot tracked in the
+// Datastore, keyed by the source snapshot ID and the destination region
+type SnapshotCopyInfo struct {
+	SourceID  SnapshotID
+	Region    string
+	ID        SnapshotID
+	CreatedAt time.Time
+}
+
+// Datastore is the persistence interface snapshot managers use to keep track
+// of the snapshots they created and deleted
+type Datastore interface {
+	StoreSnapshotInfo(info *SnapshotInfo) error
+	DeleteSnapshotInfo(info *SnapshotInfo) error
+
+	StoreSnapshotCopyInfo(info *SnapshotCopyInfo) error
+	DeleteSnapshotCopyInfo(info *SnapshotCopyInfo) error
+	ListSnapshotCopyInfo(sourceID SnapshotID) ([]*SnapshotCopyInfo, error)
+}
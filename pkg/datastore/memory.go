@@ -0,0 +1,78 @@
+package datastore
+
+import "sync"
+
+// Memory is an in-memory Datastore implementation. It does not persist
+// across restarts and is primarily meant as a default for ad-hoc or
+// single-shot invocations.
+type Memory struct {
+	mu sync.Mutex
+
+	snapshots map[SnapshotResource]map[SnapshotID]SnapshotInfo
+	copies    map[SnapshotID]map[string]SnapshotCopyInfo
+}
+
+// NewMemory creates a new, empty Memory datastore
+func NewMemory() *Memory {
+	return &Memory{
+		snapshots: map[SnapshotResource]map[SnapshotID]SnapshotInfo{},
+		copies:    map[SnapshotID]map[string]SnapshotCopyInfo{},
+	}
+}
+
+// StoreSnapshotInfo implements Datastore
+func (m *Memory) StoreSnapshotInfo(info *SnapshotInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.snapshots[info.Resource] == nil {
+		m.snapshots[info.Resource] = map[SnapshotID]SnapshotInfo{}
+	}
+	m.snapshots[info.Resource][info.ID] = *info
+	return nil
+}
+
+// DeleteSnapshotInfo implements Datastore
+func (m *Memory) DeleteSnapshotInfo(info *SnapshotInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.snapshots[info.Resource], info.ID)
+	return nil
+}
+
+// StoreSnapshotCopyInfo implements Datastore
+func (m *Memory) StoreSnapshotCopyInfo(info *SnapshotCopyInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.copies[info.SourceID] == nil {
+		m.copies[info.SourceID] = map[string]SnapshotCopyInfo{}
+	}
+	m.copies[info.SourceID][info.Region] = *info
+	return nil
+}
+
+// DeleteSnapshotCopyInfo implements Datastore
+func (m *Memory) DeleteSnapshotCopyInfo(info *SnapshotCopyInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.copies[info.SourceID], info.Region)
+	return nil
+}
+
+// ListSnapshotCopyInfo implements Datastore
+func (m *Memory) ListSnapshotCopyInfo(sourceID SnapshotID) ([]*SnapshotCopyInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []*SnapshotCopyInfo
+	for _, info := range m.copies[sourceID] {
+		info := info
+		result = append(result, &info)
+	}
+	return result, nil
+}
+
+var _ Datastore = (*Memory)(nil)
@@ -0,0 +1,15 @@
+package datastore
+
+import "context"
+
+// Snapshotter is implemented by every per-cloud backup manager (e.g.
+// pkg/snapshot/ec2, pkg/gce) so that the top-level command can select a backend
+// without depending on any cloud-specific package
+type Snapshotter interface {
+	// Snapshot creates snapshots for all matching resources
+	Snapshot(ctx context.Context) error
+	// Prune deletes all matching snapshots that are due for deletion
+	Prune(ctx context.Context) error
+	// List returns the snapshots currently tracked by the backend
+	List(ctx context.Context) ([]SnapshotInfo, error)
+}
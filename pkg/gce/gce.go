@@ -0,0 +1,309 @@
+// Package gce implements datastore.Snapshotter for GCP persistent-disk
+// snapshots, selecting disks via labels the same way pkg/snapshot/ec2 selects EBS
+// volumes via tags.
+package gce
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+)
+
+const (
+	defaultBackupLabel      = "backup"
+	defaultRetentionLabel   = "retention"
+	defaultDeleteAfterLabel = "deleteafter"
+
+	defaultRetentionDays = 7 // Default are 7 days retention
+	defaultDescription   = "auto snapshot created by grid-x/aws-auto-snapshot"
+)
+
+var (
+	listDisksRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gce_list_disks_requests_total",
+		Help: "Total number of list disks requests",
+	})
+	listSnapshotsRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gce_list_snapshots_requests_total",
+		Help: "Total number of list snapshots requests",
+	})
+	createSnapshotRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gce_create_snapshot_requests_total",
+		Help: "Total number of create snapshot requests",
+	})
+	deleteSnapshotRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gce_delete_snapshot_requests_total",
+		Help: "Total number of delete snapshot requests",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(listDisksRequests)
+	prometheus.MustRegister(listSnapshotsRequests)
+	prometheus.MustRegister(createSnapshotRequests)
+	prometheus.MustRegister(deleteSnapshotRequests)
+}
+
+// SnapshotManager manages the snapshot creation and pruning of GCE
+// persistent-disk snapshots
+type SnapshotManager struct {
+	client  *compute.Service
+	project string
+
+	backupLabel      string
+	retentionLabel   string
+	deleteAfterLabel string
+
+	logger log.FieldLogger
+
+	datastore datastore.Datastore
+}
+
+var _ datastore.Snapshotter = (*SnapshotManager)(nil)
+
+// Opt is the type for Options of the SnapshotManager
+type Opt func(*SnapshotManager)
+
+// WithBackupLabel sets the backup label key
+func WithBackupLabel(l string) Opt {
+	return func(m *SnapshotManager) {
+		m.backupLabel = l
+	}
+}
+
+// WithRetentionLabel sets the retention label key
+func WithRetentionLabel(l string) Opt {
+	return func(m *SnapshotManager) {
+		m.retentionLabel = l
+	}
+}
+
+// WithDeleteAfterLabel sets the label key used to indicate the deletion date
+func WithDeleteAfterLabel(l string) Opt {
+	return func(m *SnapshotManager) {
+		m.deleteAfterLabel = l
+	}
+}
+
+// NewSnapshotManager creates a new SnapshotManager given a Compute Engine
+// client, a project ID and a set of Opts
+func NewSnapshotManager(client *compute.Service, project string, datastore datastore.Datastore, opts ...Opt) *SnapshotManager {
+	smgr := &SnapshotManager{
+		client:  client,
+		project: project,
+
+		backupLabel:      defaultBackupLabel,
+		retentionLabel:   defaultRetentionLabel,
+		deleteAfterLabel: defaultDeleteAfterLabel,
+
+		logger: log.New().WithFields(
+			log.Fields{
+				"component": "gce-snapshot-manager",
+			},
+		),
+		datastore: datastore,
+	}
+
+	for _, o := range opts {
+		o(smgr)
+	}
+
+	return smgr
+}
+
+// fetchDisks returns all persistent disks, across all zones, carrying the
+// configured backup label
+func (smgr *SnapshotManager) fetchDisks(ctx context.Context) ([]*compute.Disk, error) {
+	var result []*compute.Disk
+
+	call := smgr.client.Disks.AggregatedList(smgr.project).
+		Filter(fmt.Sprintf("labels.%s:*", smgr.backupLabel)).
+		Context(ctx)
+
+	err := call.Pages(ctx, func(page *compute.DiskAggregatedList) error {
+		listDisksRequests.Inc()
+		for _, scoped := range page.Items {
+			result = append(result, scoped.Disks...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// fetchSnapshots returns all snapshots carrying the configured delete-after
+// label
+func (smgr *SnapshotManager) fetchSnapshots(ctx context.Context) ([]*compute.Snapshot, error) {
+	var result []*compute.Snapshot
+
+	call := smgr.client.Snapshots.List(smgr.project).
+		Filter(fmt.Sprintf("labels.%s:*", smgr.deleteAfterLabel)).
+		Context(ctx)
+
+	err := call.Pages(ctx, func(page *compute.SnapshotList) error {
+		listSnapshotsRequests.Inc()
+		result = append(result, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// lastPathSegment extracts the trailing name component from a GCE resource
+// URL, e.g. the zone name from a zone URL or the disk name from a source
+// disk URL
+func lastPathSegment(url string) string {
+	for i := len(url) - 1; i >= 0; i-- {
+		if url[i] == '/' {
+			return url[i+1:]
+		}
+	}
+	return url
+}
+
+// Snapshot creates disk snapshots for all matching persistent disks, i.e.
+// all disks having a backup label and optionally a retention label set
+func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
+	disks, err := smgr.fetchDisks(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, disk := range disks {
+		logger := smgr.logger.WithFields(log.Fields{
+			"disk": disk.Name,
+			"zone": lastPathSegment(disk.Zone),
+		})
+
+		days := int64(defaultRetentionDays)
+		if v, ok := disk.Labels[smgr.retentionLabel]; ok {
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				logger.Warnf("Couldn't parse retention days: %+v. Falling back to default value", err)
+			} else {
+				days = parsed
+			}
+		}
+
+		created := time.Now()
+		deleteAfter := created.Add(time.Duration(days) * 24 * time.Hour)
+
+		snapshotName := fmt.Sprintf("%s-%d-auto-snapshot", disk.Name, created.UnixNano())
+
+		logger.Infof("Creating snapshot with name %s", snapshotName)
+		op, err := smgr.client.Disks.CreateSnapshot(smgr.project, lastPathSegment(disk.Zone), disk.Name, &compute.Snapshot{
+			Name:        snapshotName,
+			Description: defaultDescription,
+			Labels: map[string]string{
+				smgr.deleteAfterLabel: deleteAfter.Format(time.RFC3339),
+			},
+		}).Context(ctx).Do()
+		createSnapshotRequests.Inc()
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		if op.Error != nil && len(op.Error.Errors) > 0 {
+			logger.Errorf("Couldn't create snapshot: %+v", op.Error.Errors[0])
+			continue
+		}
+
+		if err := smgr.datastore.StoreSnapshotInfo(&datastore.SnapshotInfo{
+			Resource: datastore.SnapshotResource(disk.Name),
+			ID:       datastore.SnapshotID(snapshotName),
+			// Truncate to a minute for the same reasons pkg/snapshot/ec2 does: it is
+			// used as an ordering key in the datastore and must be stable
+			CreatedAt: created.Truncate(time.Minute),
+		}); err != nil {
+			logger.Error(err)
+			continue
+		}
+	}
+
+	return nil
+}
+
+// Prune deletes all matching disk snapshots, i.e. snapshots with a
+// delete-after label that is set to a date in the past
+func (smgr *SnapshotManager) Prune(ctx context.Context) error {
+	snaps, err := smgr.fetchSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range snaps {
+		logger := smgr.logger.WithField("snapshot", snap.Name)
+
+		value, ok := snap.Labels[smgr.deleteAfterLabel]
+		if !ok {
+			continue
+		}
+
+		deleteAfter, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			logger.Errorf("Couldn't parse label value: %+v", err)
+			continue
+		}
+		if time.Now().Before(deleteAfter) {
+			logger.Info("Snapshot not yet scheduled for deletion")
+			continue
+		}
+
+		if _, err := smgr.client.Snapshots.Delete(smgr.project, snap.Name).Context(ctx).Do(); err != nil {
+			logger.Errorf("Couldn't delete snapshot: %+v", err)
+			continue
+		}
+		deleteSnapshotRequests.Inc()
+		logger.Info("Successfully deleted snapshot")
+
+		created, err := time.Parse(time.RFC3339, snap.CreationTimestamp)
+		if err != nil {
+			created = time.Time{}
+		}
+		if err := smgr.datastore.DeleteSnapshotInfo(&datastore.SnapshotInfo{
+			Resource:  datastore.SnapshotResource(lastPathSegment(snap.SourceDisk)),
+			ID:        datastore.SnapshotID(snap.Name),
+			CreatedAt: created.Truncate(time.Minute),
+		}); err != nil {
+			smgr.logger.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// List returns the snapshots currently tracked by the manager, i.e. all
+// snapshots carrying the configured delete-after label
+func (smgr *SnapshotManager) List(ctx context.Context) ([]datastore.SnapshotInfo, error) {
+	snaps, err := smgr.fetchSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]datastore.SnapshotInfo, 0, len(snaps))
+	for _, snap := range snaps {
+		created, err := time.Parse(time.RFC3339, snap.CreationTimestamp)
+		if err != nil {
+			created = time.Time{}
+		}
+		result = append(result, datastore.SnapshotInfo{
+			Resource:  datastore.SnapshotResource(lastPathSegment(snap.SourceDisk)),
+			ID:        datastore.SnapshotID(snap.Name),
+			CreatedAt: created.Truncate(time.Minute),
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,18 @@
+package gce
+
+import "testing"
+
+func TestLastPathSegment(t *testing.T) {
+	cases := map[string]string{
+		"https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a": "us-central1-a",
+		"https://www.googleapis.com/compute/v1/projects/p/disks/my-disk":       "my-disk",
+		"no-slashes": "no-slashes",
+		"":           "",
+	}
+
+	for url, want := range cases {
+		if got := lastPathSegment(url); got != want {
+			t.Errorf("lastPathSegment(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
@@ -3,12 +3,18 @@ package ec2
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
 	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
@@ -24,6 +30,31 @@ const (
 
 	defaultRetentionDays = 7 // Default are 7 days retention
 	defaultDescription   = "auto snapshot created by grid-x/aws-auto-snapshot"
+
+	defaultShareWithTag = "share-with"
+
+	// defaultAWSManagedEBSKeyAlias is the KMS key alias used for EBS
+	// encryption by default. Snapshots encrypted with it cannot be shared
+	// with other accounts.
+	defaultAWSManagedEBSKeyAlias = "alias/aws/ebs"
+
+	// consistencyGroupIDTag marks every snapshot belonging to the same
+	// coordinated multi-volume snapshot
+	consistencyGroupIDTag = "consistency-group-id"
+
+	ssmFreezeDocument = "AWS-RunShellScript"
+
+	defaultRetryInitialBackoff     = 1 * time.Second
+	defaultRetryMaxBackoff         = 30 * time.Second
+	defaultRetryMaxAttempts        = 5
+	defaultSnapshotCreationTimeout = 20 * time.Minute
+
+	snapshotPollInterval = 15 * time.Second
+
+	// snapshotTaggingHeadroom is added on top of the snapshot (and copy)
+	// completion waits to budget for the tagging, datastore and sharing
+	// calls that follow them in the per-volume loop.
+	snapshotTaggingHeadroom = 2 * time.Minute
 )
 
 var (
@@ -47,6 +78,27 @@ var (
 		Name: "ec2_delete_snapshot_requests_total",
 		Help: "Total number of delete snapshot requests",
 	})
+	copySnapshotRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ec2_copy_snapshot_requests_total",
+		Help: "Total number of copy snapshot requests",
+	})
+	snapshotRetryTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ec2_snapshot_retry_total",
+		Help: "Total number of retried AWS requests",
+	})
+	snapshotCompletionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ec2_snapshot_completion_duration_seconds",
+		Help:    "Time between snapshot creation and it reaching the completed state",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+	})
+	modifySnapshotAttributeRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ec2_modify_snapshot_attribute_requests_total",
+		Help: "Total number of modify snapshot attribute requests",
+	})
+	kmsListAliasesRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ec2_kms_list_aliases_requests_total",
+		Help: "Total number of KMS list aliases requests",
+	})
 )
 
 func init() {
@@ -55,6 +107,11 @@ func init() {
 	prometheus.MustRegister(createSnapshotRequests)
 	prometheus.MustRegister(createTagsRequests)
 	prometheus.MustRegister(deleteSnapshotRequests)
+	prometheus.MustRegister(copySnapshotRequests)
+	prometheus.MustRegister(snapshotRetryTotal)
+	prometheus.MustRegister(snapshotCompletionDuration)
+	prometheus.MustRegister(modifySnapshotAttributeRequests)
+	prometheus.MustRegister(kmsListAliasesRequests)
 }
 
 // SnapshotManager manages the snapshot creation and pruning of EC2 EBS-based
@@ -68,11 +125,32 @@ type SnapshotManager struct {
 	retentionTag   string
 	deleteAfterTag string
 
+	copyRegions  []string
+	copyKMSKeyID string
+
+	retryInitialBackoff     time.Duration
+	retryMaxBackoff         time.Duration
+	retryMaxAttempts        int
+	snapshotCreationTimeout time.Duration
+
+	shareAccounts []string
+	shareWithTag  string
+
+	minRetainedSnapshots int
+
+	consistencyGroupTag string
+	preFreezeCommand    string
+	postThawCommand     string
+	ssmClient           *ssm.SSM
+	kmsClient           *kms.KMS
+
 	logger log.FieldLogger
 
 	datastore datastore.Datastore
 }
 
+var _ datastore.Snapshotter = (*SnapshotManager)(nil)
+
 // Opt is the type for Options of the SnapshotManager
 type Opt func(*SnapshotManager)
 
@@ -105,6 +183,92 @@ func WithDeleteAfterTag(tag string) Opt {
 	}
 }
 
+// WithCopyRegions configures a set of destination regions the manager fans
+// out a CopySnapshot call to once the source snapshot has been created and
+// tagged
+func WithCopyRegions(regions []string) Opt {
+	return func(m *SnapshotManager) {
+		m.copyRegions = regions
+	}
+}
+
+// WithCopyKMSKeyID configures the KMS key ID used to re-encrypt snapshots
+// copied to the regions configured via WithCopyRegions. If unset, copies
+// inherit the encryption status and key of the source snapshot.
+func WithCopyKMSKeyID(keyID string) Opt {
+	return func(m *SnapshotManager) {
+		m.copyKMSKeyID = keyID
+	}
+}
+
+// WithRetryBackoff configures the exponential backoff used to retry retriable
+// AWS errors (throttling, rate limiting, 5xx) encountered while creating,
+// copying or deleting snapshots. The retry interval starts at initial and
+// doubles on every attempt up to max, for at most maxAttempts attempts.
+func WithRetryBackoff(initial, max time.Duration, maxAttempts int) Opt {
+	return func(m *SnapshotManager) {
+		m.retryInitialBackoff = initial
+		m.retryMaxBackoff = max
+		m.retryMaxAttempts = maxAttempts
+	}
+}
+
+// WithSnapshotCreationTimeout sets how long the manager waits for a newly
+// created (or copied) snapshot to reach the "completed" state before giving
+// up on it
+func WithSnapshotCreationTimeout(d time.Duration) Opt {
+	return func(m *SnapshotManager) {
+		m.snapshotCreationTimeout = d
+	}
+}
+
+// WithShareAccounts configures a set of AWS account IDs that are granted
+// createVolumePermission on every snapshot the manager creates through the
+// per-volume path, in addition to any accounts listed in a volume's
+// share-with tag. Consistency group snapshots and cross-region copies are
+// not shared.
+func WithShareAccounts(accounts []string) Opt {
+	return func(m *SnapshotManager) {
+		m.shareAccounts = accounts
+	}
+}
+
+// WithMinRetainedSnapshots sets a floor on the number of snapshots Prune
+// keeps around for any one volume, even if their delete-after tag is in the
+// past. This guards against a misconfigured retention tag (e.g.
+// retention=0) wiping every backup for a volume.
+func WithMinRetainedSnapshots(n int) Opt {
+	return func(m *SnapshotManager) {
+		m.minRetainedSnapshots = n
+	}
+}
+
+// WithConsistencyGroupTag configures the tag key used to identify
+// consistency groups: volumes sharing the same value for this tag (typically
+// an EC2 instance ID or an application name) are snapshotted together using
+// the multi-volume CreateSnapshots API
+func WithConsistencyGroupTag(key string) Opt {
+	return func(m *SnapshotManager) {
+		m.consistencyGroupTag = key
+	}
+}
+
+// WithPreFreezeCommand configures an SSM AWS-RunShellScript command to run
+// on a consistency group's instance before its volumes are snapshotted
+func WithPreFreezeCommand(command string) Opt {
+	return func(m *SnapshotManager) {
+		m.preFreezeCommand = command
+	}
+}
+
+// WithPostThawCommand configures an SSM AWS-RunShellScript command to run on
+// a consistency group's instance after its volumes have been snapshotted
+func WithPostThawCommand(command string) Opt {
+	return func(m *SnapshotManager) {
+		m.postThawCommand = command
+	}
+}
+
 // NewSnapshotManager creates a new SnapshotManager given an EC2 client and a
 // set of Opts
 func NewSnapshotManager(client *awsec2.EC2, datastore datastore.Datastore, opts ...Opt) *SnapshotManager {
@@ -116,6 +280,13 @@ func NewSnapshotManager(client *awsec2.EC2, datastore datastore.Datastore, opts
 		backupTag:      defaultBackupTag,
 		deleteAfterTag: defaultDeleteAfterTag,
 
+		retryInitialBackoff:     defaultRetryInitialBackoff,
+		retryMaxBackoff:         defaultRetryMaxBackoff,
+		retryMaxAttempts:        defaultRetryMaxAttempts,
+		snapshotCreationTimeout: defaultSnapshotCreationTimeout,
+
+		shareWithTag: defaultShareWithTag,
+
 		logger: log.New().WithFields(
 			log.Fields{
 				"component": "ec2-snapshot-manager",
@@ -131,6 +302,301 @@ func NewSnapshotManager(client *awsec2.EC2, datastore datastore.Datastore, opts
 	return smgr
 }
 
+// retriableErrorCodes are AWS error codes worth retrying after a backoff
+var retriableErrorCodes = map[string]bool{
+	"RequestLimitExceeded":                  true,
+	"Throttling":                            true,
+	"ThrottlingException":                   true,
+	"SnapshotCreationPerVolumeRateExceeded": true,
+}
+
+// isRetryableError reports whether err is a transient AWS error (throttling,
+// rate limiting or a 5xx service error) that is worth retrying
+func isRetryableError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		if reqErr.StatusCode() >= 500 {
+			return true
+		}
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		return retriableErrorCodes[awsErr.Code()]
+	}
+	return false
+}
+
+// withBackoff retries fn using exponential backoff (doubling on every
+// attempt up to the manager's configured max) as long as fn returns a
+// retryable AWS error, up to the manager's configured max attempts
+func (smgr *SnapshotManager) withBackoff(ctx context.Context, fn func() error) error {
+	backoff := smgr.retryInitialBackoff
+	var err error
+	for attempt := 0; attempt < smgr.retryMaxAttempts; attempt++ {
+		if err = fn(); err == nil || !isRetryableError(err) {
+			return err
+		}
+		if attempt == smgr.retryMaxAttempts-1 {
+			break
+		}
+
+		snapshotRetryTotal.Inc()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > smgr.retryMaxBackoff {
+			backoff = smgr.retryMaxBackoff
+		}
+	}
+	return err
+}
+
+// waitForSnapshotCompleted polls DescribeSnapshots until the given snapshot
+// reaches the "completed" state or smgr.snapshotCreationTimeout elapses
+func (smgr *SnapshotManager) waitForSnapshotCompleted(ctx context.Context, client *awsec2.EC2, snapshotID string, since time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, smgr.snapshotCreationTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(snapshotPollInterval)
+	defer ticker.Stop()
+
+	for {
+		out, err := client.DescribeSnapshotsWithContext(ctx, &awsec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(snapshotID)},
+		})
+		describeSnapshotsRequests.Inc()
+		if err != nil {
+			return err
+		}
+		if len(out.Snapshots) == 1 && out.Snapshots[0].State != nil {
+			switch *out.Snapshots[0].State {
+			case awsec2.SnapshotStateCompleted:
+				snapshotCompletionDuration.Observe(time.Since(since).Seconds())
+				return nil
+			case awsec2.SnapshotStateError:
+				return fmt.Errorf("snapshot %s entered error state", snapshotID)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for snapshot %s to complete: %w", snapshotID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// validateShareAccounts rejects sharing a snapshot with its own owner
+// account, since AWS silently no-ops that rather than returning an error
+func validateShareAccounts(ownerID string, accounts []string) error {
+	for _, account := range accounts {
+		if account == ownerID {
+			return fmt.Errorf("cannot share snapshot with its own owner account %s", ownerID)
+		}
+	}
+	return nil
+}
+
+// kmsClientFor lazily creates the KMS client used to resolve a snapshot's
+// KMS key to its alias
+func (smgr *SnapshotManager) kmsClientFor() (*kms.KMS, error) {
+	if smgr.kmsClient == nil {
+		sess, err := session.NewSession(&aws.Config{
+			Region:      smgr.client.Config.Region,
+			Credentials: smgr.client.Config.Credentials,
+		})
+		if err != nil {
+			return nil, err
+		}
+		smgr.kmsClient = kms.New(sess)
+	}
+	return smgr.kmsClient, nil
+}
+
+// isDefaultEBSKey reports whether keyID, the ARN of a snapshot's KMS key,
+// resolves to the account's default AWS-managed EBS encryption key
+// (alias/aws/ebs). Snapshot.KmsKeyId is always an ARN, never an alias, so
+// the alias has to be looked up via KMS rather than string-matched.
+func (smgr *SnapshotManager) isDefaultEBSKey(ctx context.Context, keyID string) (bool, error) {
+	client, err := smgr.kmsClientFor()
+	if err != nil {
+		return false, err
+	}
+
+	out, err := client.ListAliasesWithContext(ctx, &kms.ListAliasesInput{
+		KeyId: aws.String(keyID),
+	})
+	kmsListAliasesRequests.Inc()
+	if err != nil {
+		return false, err
+	}
+	for _, alias := range out.Aliases {
+		if alias.AliasName != nil && *alias.AliasName == defaultAWSManagedEBSKeyAlias {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// shareSnapshot grants createVolumePermission on the given snapshot to the
+// configured accounts, unless it is encrypted with the default AWS-managed
+// EBS KMS key (which cannot be shared) or one of the accounts is the
+// snapshot's own owner
+func (smgr *SnapshotManager) shareSnapshot(ctx context.Context, client *awsec2.EC2, snapshotID string, accounts []string, logger log.FieldLogger) {
+	if len(accounts) == 0 {
+		return
+	}
+
+	out, err := client.DescribeSnapshotsWithContext(ctx, &awsec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snapshotID)},
+	})
+	describeSnapshotsRequests.Inc()
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if len(out.Snapshots) != 1 {
+		logger.Errorf("Couldn't determine owner of snapshot %s", snapshotID)
+		return
+	}
+	snap := out.Snapshots[0]
+
+	if snap.Encrypted != nil && *snap.Encrypted {
+		if snap.KmsKeyId == nil {
+			logger.Info("Skipping snapshot sharing: encrypted but owning KMS key is unknown")
+			return
+		}
+		isDefault, err := smgr.isDefaultEBSKey(ctx, *snap.KmsKeyId)
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+		if isDefault {
+			logger.Info("Skipping snapshot sharing: encrypted with the default AWS-managed KMS key")
+			return
+		}
+	}
+
+	if snap.OwnerId != nil {
+		if err := validateShareAccounts(*snap.OwnerId, accounts); err != nil {
+			logger.Error(err)
+			return
+		}
+	}
+
+	if err := smgr.withBackoff(ctx, func() error {
+		_, modifyErr := client.ModifySnapshotAttributeWithContext(ctx, &awsec2.ModifySnapshotAttributeInput{
+			SnapshotId:    aws.String(snapshotID),
+			Attribute:     aws.String(awsec2.SnapshotAttributeNameCreateVolumePermission),
+			OperationType: aws.String("add"),
+			UserIds:       aws.StringSlice(accounts),
+		})
+		modifySnapshotAttributeRequests.Inc()
+		return modifyErr
+	}); err != nil {
+		logger.Error(err)
+		return
+	}
+	logger.Infof("Shared snapshot %s with accounts %v", snapshotID, accounts)
+}
+
+// perVolumeTimeout bounds the entire per-volume snapshot workflow: waiting
+// for the snapshot to complete, waiting for each cross-region copy to
+// complete, and the tagging/sharing calls that follow. It must never be
+// shorter than snapshotCreationTimeout, or a snapshot that is still well
+// within its configured creation timeout would never get tagged, recorded
+// or pruned.
+func (smgr *SnapshotManager) perVolumeTimeout() time.Duration {
+	return smgr.snapshotCreationTimeout*time.Duration(1+len(smgr.copyRegions)) + snapshotTaggingHeadroom
+}
+
+// regionalClient builds an EC2 client for the given region, reusing the
+// credentials of the manager's primary client
+func (smgr *SnapshotManager) regionalClient(region string) (*awsec2.EC2, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(region),
+		Credentials: smgr.client.Config.Credentials,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return awsec2.New(sess), nil
+}
+
+// copyToRegions fans out a CopySnapshot call to all configured copy regions
+// and tracks the resulting copy IDs in the datastore, keyed by the source
+// snapshot ID and destination region
+func (smgr *SnapshotManager) copyToRegions(ctx context.Context, sourceRegion string, snapshotID string, deleteAfter time.Time, logger log.FieldLogger) {
+	for _, region := range smgr.copyRegions {
+		logger := logger.WithField("copy-region", region)
+
+		client, err := smgr.regionalClient(region)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		in := &awsec2.CopySnapshotInput{
+			SourceRegion:     aws.String(sourceRegion),
+			SourceSnapshotId: aws.String(snapshotID),
+			Description:      aws.String(defaultDescription),
+		}
+		if smgr.copyKMSKeyID != "" {
+			in.Encrypted = aws.Bool(true)
+			in.KmsKeyId = aws.String(smgr.copyKMSKeyID)
+		}
+
+		var out *awsec2.CopySnapshotOutput
+		err = smgr.withBackoff(ctx, func() error {
+			var copyErr error
+			out, copyErr = client.CopySnapshotWithContext(ctx, in)
+			copySnapshotRequests.Inc()
+			return copyErr
+		})
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		if out.SnapshotId == nil {
+			logger.Errorf("Copy snapshot ID is nil.")
+			continue
+		}
+
+		if err := smgr.waitForSnapshotCompleted(ctx, client, *out.SnapshotId, time.Now()); err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		if _, err := client.CreateTagsWithContext(ctx, &awsec2.CreateTagsInput{
+			Resources: []*string{out.SnapshotId},
+			Tags: []*awsec2.Tag{
+				{
+					Key:   aws.String(smgr.deleteAfterTag),
+					Value: aws.String(deleteAfter.Format(time.RFC3339)),
+				},
+			},
+		}); err != nil {
+			logger.Error(err)
+			continue
+		}
+		createTagsRequests.Inc()
+
+		if err := smgr.datastore.StoreSnapshotCopyInfo(&datastore.SnapshotCopyInfo{
+			SourceID:  datastore.SnapshotID(snapshotID),
+			Region:    region,
+			ID:        datastore.SnapshotID(*out.SnapshotId),
+			CreatedAt: time.Now(),
+		}); err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		logger.Infof("Copied snapshot to %s", *out.SnapshotId)
+	}
+}
+
 func (smgr *SnapshotManager) fetchVolumes(ctx context.Context) ([]*awsec2.Volume, error) {
 	var result []*awsec2.Volume
 	var token *string
@@ -214,6 +680,246 @@ func (smgr *SnapshotManager) fetchSnapshots(ctx context.Context) ([]*awsec2.Snap
 	return result, nil
 }
 
+// runSSMCommand runs an AWS-RunShellScript SSM command on the given instance
+// and waits for it to finish. It is a no-op if command is empty.
+func (smgr *SnapshotManager) runSSMCommand(ctx context.Context, instanceID, command string, logger log.FieldLogger) error {
+	if command == "" {
+		return nil
+	}
+
+	if smgr.ssmClient == nil {
+		sess, err := session.NewSession(&aws.Config{
+			Region:      smgr.client.Config.Region,
+			Credentials: smgr.client.Config.Credentials,
+		})
+		if err != nil {
+			return err
+		}
+		smgr.ssmClient = ssm.New(sess)
+	}
+	ssmClient := smgr.ssmClient
+
+	out, err := ssmClient.SendCommandWithContext(ctx, &ssm.SendCommandInput{
+		DocumentName: aws.String(ssmFreezeDocument),
+		InstanceIds:  []*string{aws.String(instanceID)},
+		Parameters: map[string][]*string{
+			"commands": aws.StringSlice([]string{command}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Waiting for SSM command %s to finish on instance %s", *out.Command.CommandId, instanceID)
+	return ssmClient.WaitUntilCommandExecutedWithContext(ctx, &ssm.GetCommandInvocationInput{
+		CommandId:  out.Command.CommandId,
+		InstanceId: aws.String(instanceID),
+	})
+}
+
+// consistencyGroupRetentionDays returns the retention period, in days, for a
+// consistency group: the largest retention tag value actually present among
+// its member volumes, or defaultRetentionDays if none of them carry the tag.
+func consistencyGroupRetentionDays(members []*awsec2.Volume, retentionTag string) int64 {
+	var days int64
+	found := false
+	for _, volume := range members {
+		for _, tag := range volume.Tags {
+			if tag.Key == nil || tag.Value == nil || strings.ToLower(*tag.Key) != strings.ToLower(retentionTag) {
+				continue
+			}
+			if parsed, err := strconv.ParseInt(*tag.Value, 10, 64); err == nil {
+				found = true
+				if parsed > days {
+					days = parsed
+				}
+			}
+		}
+	}
+	if !found {
+		days = defaultRetentionDays
+	}
+	return days
+}
+
+// splitConsistencyGroupSnapshots splits the snapshots returned by
+// CreateSnapshots into the ones belonging to the consistency group (i.e.
+// their volume is in memberIDs) and the ones that were swept in because
+// they share the same instance but aren't tagged as group members.
+func splitConsistencyGroupSnapshots(snapshots []*awsec2.SnapshotInfo, memberIDs map[string]bool) (members, others []*awsec2.SnapshotInfo) {
+	for _, snap := range snapshots {
+		if snap.SnapshotId == nil || snap.VolumeId == nil {
+			continue
+		}
+		if memberIDs[*snap.VolumeId] {
+			members = append(members, snap)
+		} else {
+			others = append(others, snap)
+		}
+	}
+	return members, others
+}
+
+// snapshotConsistencyGroups snapshots every consistency group found among
+// volumes (i.e. volumes sharing the same consistencyGroupTag value) using
+// the multi-volume CreateSnapshots API, so that all member volumes get a
+// matching timestamp. It returns the set of volume IDs it handled, so the
+// caller can skip them in the regular per-volume path.
+func (smgr *SnapshotManager) snapshotConsistencyGroups(ctx context.Context, volumes []*awsec2.Volume) map[string]bool {
+	handled := map[string]bool{}
+	if smgr.consistencyGroupTag == "" {
+		return handled
+	}
+
+	groups := map[string][]*awsec2.Volume{}
+	for _, volume := range volumes {
+		for _, tag := range volume.Tags {
+			if tag.Key != nil && *tag.Key == smgr.consistencyGroupTag && tag.Value != nil {
+				groups[*tag.Value] = append(groups[*tag.Value], volume)
+				break
+			}
+		}
+	}
+
+	for groupValue, members := range groups {
+		logger := smgr.logger.WithField("consistency-group", groupValue)
+
+		memberIDs := map[string]bool{}
+		for _, volume := range members {
+			if volume.VolumeId != nil {
+				memberIDs[*volume.VolumeId] = true
+			}
+		}
+
+		var instanceID string
+		for _, volume := range members {
+			if len(volume.Attachments) > 0 && volume.Attachments[0].InstanceId != nil {
+				instanceID = *volume.Attachments[0].InstanceId
+				break
+			}
+		}
+		if instanceID == "" {
+			logger.Errorf("No attached instance found for consistency group %s, falling back to per-volume snapshots", groupValue)
+			continue
+		}
+		// handled is only updated once we know which volumes actually got a
+		// snapshot, so a failed pre-freeze, CreateSnapshots call or tagging
+		// step leaves every member volume to the regular per-volume
+		// fallback below instead of silently skipping it.
+
+		days := consistencyGroupRetentionDays(members, smgr.retentionTag)
+		deleteAfter := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+
+		if err := smgr.runSSMCommand(ctx, instanceID, smgr.preFreezeCommand, logger); err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		out, err := smgr.client.CreateSnapshotsWithContext(ctx, &awsec2.CreateSnapshotsInput{
+			Description: aws.String(defaultDescription),
+			InstanceSpecification: &awsec2.InstanceSpecification{
+				InstanceId: aws.String(instanceID),
+			},
+		})
+		createSnapshotRequests.Inc()
+
+		if err := smgr.runSSMCommand(ctx, instanceID, smgr.postThawCommand, logger); err != nil {
+			logger.Error(err)
+		}
+
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		var snapshotIDs []*string
+		for _, snap := range out.Snapshots {
+			if snap.SnapshotId != nil {
+				snapshotIDs = append(snapshotIDs, snap.SnapshotId)
+			}
+		}
+		if len(snapshotIDs) == 0 {
+			logger.Errorf("CreateSnapshots for instance %s returned no snapshots", instanceID)
+			continue
+		}
+
+		// CreateSnapshots operates on the whole instance, so it may also
+		// cover volumes that aren't tagged as part of this group. Those are
+		// now snapshotted regardless, so tag them with the delete-after tag
+		// only, to avoid attributing them to a consistency group they
+		// aren't actually part of, and still mark them handled so the
+		// per-volume loop below doesn't snapshot them a second time.
+		consistencyGroupID := uuid.New().String()
+		members, others := splitConsistencyGroupSnapshots(out.Snapshots, memberIDs)
+		for _, snap := range others {
+			logger.Warnf("Volume %s was swept into consistency group snapshot %s because it shares instance %s, but isn't tagged as a group member", *snap.VolumeId, *snap.SnapshotId, instanceID)
+		}
+
+		memberSnapshotIDs := make([]*string, 0, len(members))
+		for _, snap := range members {
+			memberSnapshotIDs = append(memberSnapshotIDs, snap.SnapshotId)
+		}
+		otherSnapshotIDs := make([]*string, 0, len(others))
+		for _, snap := range others {
+			otherSnapshotIDs = append(otherSnapshotIDs, snap.SnapshotId)
+		}
+
+		if len(memberSnapshotIDs) > 0 {
+			if _, err := smgr.client.CreateTagsWithContext(ctx, &awsec2.CreateTagsInput{
+				Resources: memberSnapshotIDs,
+				Tags: []*awsec2.Tag{
+					{
+						Key:   aws.String(consistencyGroupIDTag),
+						Value: aws.String(consistencyGroupID),
+					},
+					{
+						Key:   aws.String(smgr.deleteAfterTag),
+						Value: aws.String(deleteAfter.Format(time.RFC3339)),
+					},
+				},
+			}); err != nil {
+				logger.Error(err)
+				continue
+			}
+			createTagsRequests.Inc()
+		}
+		if len(otherSnapshotIDs) > 0 {
+			if _, err := smgr.client.CreateTagsWithContext(ctx, &awsec2.CreateTagsInput{
+				Resources: otherSnapshotIDs,
+				Tags: []*awsec2.Tag{
+					{
+						Key:   aws.String(smgr.deleteAfterTag),
+						Value: aws.String(deleteAfter.Format(time.RFC3339)),
+					},
+				},
+			}); err != nil {
+				logger.Error(err)
+				continue
+			}
+			createTagsRequests.Inc()
+		}
+
+		for _, snap := range out.Snapshots {
+			if snap.SnapshotId == nil || snap.VolumeId == nil {
+				continue
+			}
+			if err := smgr.datastore.StoreSnapshotInfo(&datastore.SnapshotInfo{
+				Resource:  datastore.SnapshotResource(*snap.VolumeId),
+				ID:        datastore.SnapshotID(*snap.SnapshotId),
+				CreatedAt: time.Now().Truncate(time.Minute),
+			}); err != nil {
+				logger.Error(err)
+				continue
+			}
+			handled[*snap.VolumeId] = true
+		}
+
+		logger.Infof("Created consistency group %s covering %d volumes", consistencyGroupID, len(memberSnapshotIDs))
+	}
+
+	return handled
+}
+
 // Snapshot creates EBS snapshots for all matching EBS volumes, i.e. all EBS
 // volumes having a Backup tag and optionally a retention tag set
 func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
@@ -223,9 +929,13 @@ func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
 		return err
 	}
 
+	handledByConsistencyGroup := smgr.snapshotConsistencyGroups(ctx, volumes)
+
 	for _, volume := range volumes {
-		// For each volume it should at most take 5 minutes
-		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		if volume.VolumeId != nil && handledByConsistencyGroup[*volume.VolumeId] {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, smgr.perVolumeTimeout())
 		defer cancel()
 
 		snapshotName := fmt.Sprintf("%s-%d-%s",
@@ -268,14 +978,19 @@ func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
 		deleteAfter := created.Add(time.Duration(days) * 24 * time.Hour)
 
 		logger.Infof("Creating snapshot with name %s", snapshotName)
-		snapshot, err := smgr.client.CreateSnapshotWithContext(
-			ctx,
-			&awsec2.CreateSnapshotInput{
-				VolumeId:    volume.VolumeId,
-				Description: aws.String(defaultDescription),
-			},
-		)
-		createSnapshotRequests.Inc()
+		var snapshot *awsec2.Snapshot
+		err = smgr.withBackoff(ctx, func() error {
+			var createErr error
+			snapshot, createErr = smgr.client.CreateSnapshotWithContext(
+				ctx,
+				&awsec2.CreateSnapshotInput{
+					VolumeId:    volume.VolumeId,
+					Description: aws.String(defaultDescription),
+				},
+			)
+			createSnapshotRequests.Inc()
+			return createErr
+		})
 		if err != nil {
 			logger.Error(err)
 			continue
@@ -286,6 +1001,11 @@ func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
 			continue
 		}
 
+		if err := smgr.waitForSnapshotCompleted(ctx, smgr.client, *snapshot.SnapshotId, created); err != nil {
+			logger.Error(err)
+			continue
+		}
+
 		tags := []*awsec2.Tag{
 			{
 				Key:   aws.String("Name"),
@@ -333,66 +1053,255 @@ func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
 			logger.Error(err)
 			continue
 		}
+
+		if len(smgr.copyRegions) > 0 {
+			if smgr.client.Config.Region == nil || *smgr.client.Config.Region == "" {
+				logger.Error("Couldn't determine source region for cross-region copy: EC2 client has no region configured")
+			} else {
+				smgr.copyToRegions(ctx, *smgr.client.Config.Region, *snapshot.SnapshotId, deleteAfter, logger)
+			}
+		}
+
+		shareAccounts := append([]string{}, smgr.shareAccounts...)
+		for _, tag := range volume.Tags {
+			if tag.Key == nil || tag.Value == nil || strings.ToLower(*tag.Key) != strings.ToLower(smgr.shareWithTag) {
+				continue
+			}
+			for _, account := range strings.Split(*tag.Value, ",") {
+				if account = strings.TrimSpace(account); account != "" {
+					shareAccounts = append(shareAccounts, account)
+				}
+			}
+		}
+		smgr.shareSnapshot(ctx, smgr.client, *snapshot.SnapshotId, shareAccounts, logger)
 	}
 	return nil
 }
 
+// pruneRegionalCopies deletes the cross-region copies tracked for the given
+// source snapshot ID in all of the manager's configured copy regions
+func (smgr *SnapshotManager) pruneRegionalCopies(ctx context.Context, sourceSnapshotID string, logger log.FieldLogger) {
+	if len(smgr.copyRegions) == 0 {
+		return
+	}
+
+	copies, err := smgr.datastore.ListSnapshotCopyInfo(datastore.SnapshotID(sourceSnapshotID))
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	for _, copy := range copies {
+		logger := logger.WithFields(log.Fields{
+			"copy-region":   copy.Region,
+			"copy-snapshot": copy.ID,
+		})
+
+		client, err := smgr.regionalClient(copy.Region)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		err = smgr.withBackoff(ctx, func() error {
+			_, deleteErr := client.DeleteSnapshotWithContext(ctx, &awsec2.DeleteSnapshotInput{
+				SnapshotId: aws.String(string(copy.ID)),
+			})
+			deleteSnapshotRequests.Inc()
+			return deleteErr
+		})
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		if err := smgr.datastore.DeleteSnapshotCopyInfo(copy); err != nil {
+			logger.Error(err)
+			continue
+		}
+		logger.Info("Successfully deleted regional snapshot copy")
+	}
+}
+
+// List returns the snapshots currently tracked by the manager, i.e. all
+// snapshots carrying the configured delete-after tag
+func (smgr *SnapshotManager) List(ctx context.Context) ([]datastore.SnapshotInfo, error) {
+	snaps, err := smgr.fetchSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]datastore.SnapshotInfo, 0, len(snaps))
+	for _, snap := range snaps {
+		if snap.SnapshotId == nil || snap.VolumeId == nil || snap.StartTime == nil {
+			continue
+		}
+		result = append(result, datastore.SnapshotInfo{
+			Resource:  datastore.SnapshotResource(*snap.VolumeId),
+			ID:        datastore.SnapshotID(*snap.SnapshotId),
+			CreatedAt: (*snap.StartTime).Truncate(time.Minute),
+		})
+	}
+	return result, nil
+}
+
 // Prune deletes all matching EBS snapshots, i.e. snapshots with a delete after
-// tag that is set to a date in the past
+// tag that is set to a date in the past, while never letting fewer than
+// minRetainedSnapshots snapshots remain for any one volume
 func (smgr *SnapshotManager) Prune(ctx context.Context) error {
 
 	snaps, err := smgr.fetchSnapshots(ctx)
 	if err != nil {
 		return err
 	}
+
+	byVolume := map[string][]*awsec2.Snapshot{}
+	byConsistencyGroup := map[string][]*awsec2.Snapshot{}
 	for _, snap := range snaps {
-		smgr.logger.Infof("Processing snapshot %s", *snap.SnapshotId)
-		for _, tag := range snap.Tags {
-			if tag.Key == nil {
+		if snap.VolumeId != nil {
+			byVolume[*snap.VolumeId] = append(byVolume[*snap.VolumeId], snap)
+		}
+		if groupID, ok := tagValue(snap, consistencyGroupIDTag); ok {
+			byConsistencyGroup[groupID] = append(byConsistencyGroup[groupID], snap)
+		}
+	}
+
+	for _, group := range byVolume {
+		candidates := candidatesForVolume(group, smgr.minRetainedSnapshots)
+		if protected := len(group) - len(candidates); protected > 0 {
+			smgr.logger.Infof(
+				"Skipping deletion of %d snapshot(s) to keep at least %d for volume %s", protected, smgr.minRetainedSnapshots, *group[0].VolumeId)
+		}
+
+		for _, snap := range candidates {
+			smgr.logger.Infof("Processing snapshot %s", *snap.SnapshotId)
+			smgr.pruneSnapshot(ctx, snap, byConsistencyGroup)
+		}
+	}
+
+	return nil
+}
+
+// candidatesForVolume sorts a single volume's snapshots oldest-first and
+// returns the prefix eligible for deletion consideration, after protecting
+// at least minRetained of its most recent snapshots regardless of their
+// delete-after tag.
+func candidatesForVolume(group []*awsec2.Snapshot, minRetained int) []*awsec2.Snapshot {
+	sort.Slice(group, func(i, j int) bool {
+		return group[i].StartTime.Before(*group[j].StartTime)
+	})
+
+	protected := minRetained
+	if protected > len(group) {
+		protected = len(group)
+	}
+	return group[:len(group)-protected]
+}
+
+// tagValue returns the value of the tag with the given key, if present
+func tagValue(snap *awsec2.Snapshot, key string) (string, bool) {
+	for _, tag := range snap.Tags {
+		if tag.Key != nil && *tag.Key == key && tag.Value != nil {
+			return *tag.Value, true
+		}
+	}
+	return "", false
+}
+
+// consistencyGroupExpired reports whether every member of a consistency
+// group has a delete-after tag set to a date in the past
+func (smgr *SnapshotManager) consistencyGroupExpired(group []*awsec2.Snapshot) bool {
+	for _, member := range group {
+		value, ok := tagValue(member, smgr.deleteAfterTag)
+		if !ok {
+			return false
+		}
+		deleteAfter, err := time.Parse(time.RFC3339, value)
+		if err != nil || time.Now().Before(deleteAfter) {
+			return false
+		}
+	}
+	return true
+}
+
+// pruneSnapshot deletes a single snapshot if its delete-after tag is set to
+// a date in the past. Snapshots belonging to a consistency group are only
+// deleted once every member of the group is due for deletion.
+func (smgr *SnapshotManager) pruneSnapshot(ctx context.Context, snap *awsec2.Snapshot, byConsistencyGroup map[string][]*awsec2.Snapshot) {
+	if groupID, ok := tagValue(snap, consistencyGroupIDTag); ok {
+		if !smgr.consistencyGroupExpired(byConsistencyGroup[groupID]) {
+			smgr.logger.WithField("snapshotID", *snap.SnapshotId).Infof(
+				"Skipping deletion: consistency group %s still has unexpired members", groupID)
+			return
+		}
+	}
+
+	for _, tag := range snap.Tags {
+		if tag.Key == nil {
+			continue
+		}
+		if *tag.Key == smgr.deleteAfterTag {
+			// add context to the logger
+			logger := smgr.logger.WithFields(log.Fields{
+				"snapshotID": *snap.SnapshotId,
+			})
+			if tag.Value == nil {
+				logger.Errorf("Delete after tag value is nil")
 				continue
 			}
-			if *tag.Key == smgr.deleteAfterTag {
-				// add context to the logger
-				logger := smgr.logger.WithFields(log.Fields{
-					"snapshotID": *snap.SnapshotId,
-				})
-				if tag.Value == nil {
-					logger.Errorf("Delete after tag value is nil")
-					continue
-				}
 
-				deleteAfter, err := time.Parse(time.RFC3339, *tag.Value)
-				if err != nil {
-					logger.Error("Couldn't parse tag value for : %+v", err)
-					break
-				}
-				if time.Now().Before(deleteAfter) {
-					logger.Info("Snapshot not yet scheduled for deletion")
-					break
-				}
-				if _, err := smgr.client.DeleteSnapshotWithContext(ctx, &awsec2.DeleteSnapshotInput{
+			deleteAfter, err := time.Parse(time.RFC3339, *tag.Value)
+			if err != nil {
+				logger.Errorf("Couldn't parse tag value for : %+v", err)
+				break
+			}
+			if time.Now().Before(deleteAfter) {
+				logger.Info("Snapshot not yet scheduled for deletion")
+				break
+			}
+			if err := smgr.withBackoff(ctx, func() error {
+				_, deleteErr := smgr.client.DeleteSnapshotWithContext(ctx, &awsec2.DeleteSnapshotInput{
 					SnapshotId: snap.SnapshotId,
-				}); err != nil {
-					logger.Error("Couldn't delete snapshot: %+v", err)
-					break
-				}
+				})
 				deleteSnapshotRequests.Inc()
-				logger.Info("Successfully deleted snapshot")
-				if err := smgr.datastore.DeleteSnapshotInfo(&datastore.SnapshotInfo{
-					Resource: datastore.SnapshotResource(*snap.VolumeId),
-					ID:       datastore.SnapshotID(*snap.SnapshotId),
-					// The createdAt timestamp is used as a key for ordering
-					// in the datatstore. Hence we need to ensure it is
-					// stable. To avoid problems it was truncated to one
-					// minute during creation above
-					CreatedAt: (*snap.StartTime).Truncate(time.Minute),
-				}); err != nil {
-					smgr.logger.Error(err)
-				}
+				return deleteErr
+			}); err != nil {
+				logger.Errorf("Couldn't delete snapshot: %+v", err)
 				break
 			}
+			logger.Info("Successfully deleted snapshot")
+			if err := smgr.datastore.DeleteSnapshotInfo(&datastore.SnapshotInfo{
+				Resource: datastore.SnapshotResource(*snap.VolumeId),
+				ID:       datastore.SnapshotID(*snap.SnapshotId),
+				// The createdAt timestamp is used as a key for ordering
+				// in the datatstore. Hence we need to ensure it is
+				// stable. To avoid problems it was truncated to one
+				// minute during creation above
+				CreatedAt: (*snap.StartTime).Truncate(time.Minute),
+			}); err != nil {
+				smgr.logger.Error(err)
+			}
+			smgr.pruneRegionalCopies(ctx, *snap.SnapshotId, logger)
+			break
 		}
 	}
+}
 
-	return nil
+// GarbageCollector runs Prune on a fixed interval until ctx is cancelled,
+// allowing operators to run continuous pruning instead of one-shot
+// invocations
+func (smgr *SnapshotManager) GarbageCollector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := smgr.Prune(ctx); err != nil {
+				smgr.logger.Error(err)
+			}
+		}
+	}
 }
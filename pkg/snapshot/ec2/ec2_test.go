@@ -0,0 +1,98 @@
+package ec2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestValidateShareAccountsRejectsOwner(t *testing.T) {
+	if err := validateShareAccounts("111111111111", []string{"222222222222", "111111111111"}); err == nil {
+		t.Fatal("expected an error when sharing with the snapshot's own owner account")
+	}
+}
+
+func TestValidateShareAccountsAllowsOthers(t *testing.T) {
+	if err := validateShareAccounts("111111111111", []string{"222222222222", "333333333333"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func snapshotAt(id string, t time.Time) *awsec2.Snapshot {
+	return &awsec2.Snapshot{
+		SnapshotId: aws.String(id),
+		VolumeId:   aws.String("vol-1"),
+		StartTime:  aws.Time(t),
+	}
+}
+
+func TestCandidatesForVolumeProtectsMinRetainedSnapshots(t *testing.T) {
+	now := time.Now()
+	group := []*awsec2.Snapshot{
+		snapshotAt("snap-3", now),
+		snapshotAt("snap-1", now.Add(-2*time.Hour)),
+		snapshotAt("snap-2", now.Add(-time.Hour)),
+	}
+
+	candidates := candidatesForVolume(group, 2)
+
+	if len(candidates) != 1 || *candidates[0].SnapshotId != "snap-1" {
+		t.Fatalf("expected only the oldest snapshot to be a deletion candidate, got %+v", candidates)
+	}
+}
+
+func TestCandidatesForVolumeMinRetainedExceedsGroupSize(t *testing.T) {
+	group := []*awsec2.Snapshot{snapshotAt("snap-1", time.Now())}
+
+	if candidates := candidatesForVolume(group, 5); len(candidates) != 0 {
+		t.Fatalf("expected no deletion candidates when minRetained exceeds the group size, got %+v", candidates)
+	}
+}
+
+func TestSplitConsistencyGroupSnapshots(t *testing.T) {
+	memberIDs := map[string]bool{"vol-member": true}
+	snapshots := []*awsec2.SnapshotInfo{
+		{SnapshotId: aws.String("snap-member"), VolumeId: aws.String("vol-member")},
+		{SnapshotId: aws.String("snap-other"), VolumeId: aws.String("vol-other")},
+	}
+
+	members, others := splitConsistencyGroupSnapshots(snapshots, memberIDs)
+
+	if len(members) != 1 || *members[0].SnapshotId != "snap-member" {
+		t.Fatalf("expected only snap-member in members, got %+v", members)
+	}
+	if len(others) != 1 || *others[0].SnapshotId != "snap-other" {
+		t.Fatalf("expected only snap-other in others, got %+v", others)
+	}
+}
+
+func TestConsistencyGroupRetentionDaysTakesMaxOfPresentTags(t *testing.T) {
+	members := []*awsec2.Volume{
+		{Tags: []*awsec2.Tag{{Key: aws.String("retention"), Value: aws.String("1")}}},
+		{Tags: []*awsec2.Tag{{Key: aws.String("retention"), Value: aws.String("3")}}},
+	}
+
+	if days := consistencyGroupRetentionDays(members, "retention"); days != 3 {
+		t.Fatalf("expected 3, got %d", days)
+	}
+}
+
+func TestConsistencyGroupRetentionDaysHonorsSmallerTagsThanDefault(t *testing.T) {
+	members := []*awsec2.Volume{
+		{Tags: []*awsec2.Tag{{Key: aws.String("retention"), Value: aws.String("1")}}},
+	}
+
+	if days := consistencyGroupRetentionDays(members, "retention"); days != 1 {
+		t.Fatalf("expected the tag value 1 to be honored instead of the default, got %d", days)
+	}
+}
+
+func TestConsistencyGroupRetentionDaysFallsBackToDefaultWhenUntagged(t *testing.T) {
+	members := []*awsec2.Volume{{}}
+
+	if days := consistencyGroupRetentionDays(members, "retention"); days != defaultRetentionDays {
+		t.Fatalf("expected default retention of %d, got %d", defaultRetentionDays, days)
+	}
+}